@@ -0,0 +1,36 @@
+/*
+Copyright 2014 The Camlistore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import "camlistore.org/pkg/blob"
+
+// BlobChangeReceiver is implemented by callers that want to learn about
+// blobs written or removed directly in a Storage implementation's backing
+// store by some other process, such as a second Camlistore instance or a
+// parallel uploader sharing the same bucket or directory. A Storage that
+// supports this typically exposes a SetBlobChangeReceiver method; nothing
+// in this package wires one up automatically. A Storage may also report
+// changes made through its own ReceiveBlob and RemoveBlobs calls.
+type BlobChangeReceiver interface {
+	// OnBlobReceived is called when the owning Storage observes that ref
+	// was written to its backing store.
+	OnBlobReceived(ref blob.Ref)
+
+	// OnBlobRemoved is called when the owning Storage observes that ref
+	// was removed from its backing store.
+	OnBlobRemoved(ref blob.Ref)
+}
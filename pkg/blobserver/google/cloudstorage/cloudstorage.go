@@ -0,0 +1,420 @@
+/*
+Copyright 2014 The Camlistore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloudstorage registers the "googlecloudstorage" blob storage type,
+// storing blobs in a Google Cloud Storage bucket.
+package cloudstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/context"
+	"camlistore.org/pkg/jsonconfig"
+	"camlistore.org/third_party/code.google.com/p/goauth2/oauth"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	gc "golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/cloud/compute/metadata"
+)
+
+// gcsScope is the OAuth2 scope required for read/write access to GCS
+// buckets and objects.
+const gcsScope = "https://www.googleapis.com/auth/devstorage.full_control"
+
+// Storage implements blobserver.Storage for blobs stored on Google Cloud
+// Storage.
+type Storage struct {
+	client    *storage.Client
+	bucket    string
+	dirPrefix string
+
+	// changesMu guards changes, which is set by SetBlobChangeReceiver
+	// and read by handleNotification from the notifyLoop goroutine.
+	changesMu sync.Mutex
+	// changes, if non-nil, is notified of blobs written or removed in
+	// this bucket, as observed via sub.
+	changes blobserver.BlobChangeReceiver
+
+	sub       *pubsub.Subscription
+	subCancel gc.CancelFunc
+	subDone   chan struct{}
+}
+
+func (gs *Storage) String() string {
+	if gs.dirPrefix == "" {
+		return fmt.Sprintf("\"Google Cloud Storage\" blob storage at bucket %q", gs.bucket)
+	}
+	return fmt.Sprintf("\"Google Cloud Storage\" blob storage at bucket %q, directory %q", gs.bucket, gs.dirPrefix)
+}
+
+func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	var (
+		bucket             = config.RequiredString("bucket")
+		auth               = config.RequiredObject("auth")
+		pubsubSubscription = config.OptionalString("pubsub_subscription", "")
+		projectID          = config.OptionalString("project_id", "")
+	)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	transport, err := authTransport(auth)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.Validate(); err != nil {
+		return nil, err
+	}
+
+	var dirPrefix string
+	if parts := strings.SplitN(bucket, "/", 2); len(parts) > 1 {
+		bucket, dirPrefix = parts[0], parts[1]
+		if !strings.HasSuffix(dirPrefix, "/") {
+			dirPrefix += "/"
+		}
+	}
+
+	httpClient := &http.Client{Transport: transport}
+	client, err := storage.NewClient(gc.Background(), option.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, fmt.Errorf("cloudstorage: creating storage client: %v", err)
+	}
+
+	gs := &Storage{
+		client:    client,
+		bucket:    bucket,
+		dirPrefix: dirPrefix,
+	}
+
+	if pubsubSubscription != "" {
+		if projectID == "" {
+			id, err := metadata.ProjectID()
+			if err != nil {
+				return nil, fmt.Errorf("cloudstorage: pubsub_subscription configured but project_id isn't set and we're not running on GCE: %v", err)
+			}
+			projectID = id
+		}
+		psClient, err := pubsub.NewClient(gc.Background(), projectID, option.WithHTTPClient(httpClient))
+		if err != nil {
+			return nil, fmt.Errorf("cloudstorage: creating pubsub client: %v", err)
+		}
+		gs.sub = psClient.Subscription(pubsubSubscription)
+		gs.subDone = make(chan struct{})
+		var ctx gc.Context
+		ctx, gs.subCancel = gc.WithCancel(gc.Background())
+		go gs.notifyLoop(ctx)
+	}
+
+	return gs, nil
+}
+
+// authTransport returns the http.RoundTripper used to authenticate requests
+// to Google Cloud Storage. It tries, in order: an explicit OAuth2 refresh
+// token configured in the auth block; a service-account JSON key, either
+// inline or read from a json_key file path, exchanged via
+// google.JWTConfigFromJSON; Application Default Credentials, as found by
+// google.FindDefaultCredentials (honoring GOOGLE_APPLICATION_CREDENTIALS and
+// the gcloud well-known file); and finally, when running on a GCE instance,
+// a token fetched directly from the instance metadata server.
+func authTransport(auth jsonconfig.Obj) (http.RoundTripper, error) {
+	clientID := auth.OptionalString("client_id", "")
+	clientSecret := auth.OptionalString("client_secret", "")
+	refreshToken := auth.OptionalString("refresh_token", "")
+	serviceAccount := auth.OptionalString("service_account", "default")
+	jsonKey := auth.OptionalString("json_key", "")
+
+	if clientID != "" || clientSecret != "" || refreshToken != "" {
+		if clientID == "" || clientSecret == "" || refreshToken == "" {
+			return nil, errors.New("cloudstorage: client_id, client_secret and refresh_token must all be set together")
+		}
+		return &oauth.Transport{
+			Config: &oauth.Config{
+				ClientId:     clientID,
+				ClientSecret: clientSecret,
+				Scope:        gcsScope,
+				AuthURL:      "https://accounts.google.com/o/oauth2/auth",
+				TokenURL:     "https://accounts.google.com/o/oauth2/token",
+			},
+			Token: &oauth.Token{RefreshToken: refreshToken},
+		}, nil
+	}
+
+	if jsonKey != "" {
+		keyData := []byte(jsonKey)
+		if !strings.HasPrefix(strings.TrimSpace(jsonKey), "{") {
+			// Not inline JSON; treat it as a path to a JSON key file.
+			data, err := ioutil.ReadFile(jsonKey)
+			if err != nil {
+				return nil, fmt.Errorf("cloudstorage: reading json_key file: %v", err)
+			}
+			keyData = data
+		}
+		jwtConf, err := google.JWTConfigFromJSON(keyData, gcsScope)
+		if err != nil {
+			return nil, fmt.Errorf("cloudstorage: parsing json_key: %v", err)
+		}
+		return &oauth2.Transport{Source: jwtConf.TokenSource(oauth2.NoContext)}, nil
+	}
+
+	if creds, err := google.FindDefaultCredentials(oauth2.NoContext, gcsScope); err == nil {
+		return &oauth2.Transport{Source: creds.TokenSource}, nil
+	}
+
+	if metadata.OnGCE() {
+		return &oauth2.Transport{Source: gceMetadataTokenSource(serviceAccount)}, nil
+	}
+
+	return nil, errors.New("cloudstorage: no auth configured, and no Application Default Credentials or GCE metadata service found")
+}
+
+// gceMetadataTokenSource returns an oauth2.TokenSource that fetches an
+// access token for serviceAccount from the GCE metadata server, and
+// automatically re-fetches it once it nears expiry.
+func gceMetadataTokenSource(serviceAccount string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &gceMetadataTokenFetcher{account: serviceAccount})
+}
+
+// gceMetadataTokenFetcher implements oauth2.TokenSource by querying the GCE
+// metadata server for the given service account's current access token.
+type gceMetadataTokenFetcher struct {
+	account string
+}
+
+func (f *gceMetadataTokenFetcher) Token() (*oauth2.Token, error) {
+	suffix := fmt.Sprintf("instance/service-accounts/%s/token", f.account)
+	body, err := metadata.Get(suffix)
+	if err != nil {
+		return nil, fmt.Errorf("cloudstorage: fetching token from GCE metadata server: %v", err)
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(strings.NewReader(body)).Decode(&res); err != nil {
+		return nil, fmt.Errorf("cloudstorage: decoding GCE metadata token response: %v", err)
+	}
+	return &oauth2.Token{
+		AccessToken: res.AccessToken,
+		TokenType:   res.TokenType,
+		Expiry:      time.Now().Add(time.Duration(res.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (gs *Storage) key(blobRef blob.Ref) string {
+	return gs.dirPrefix + blobRef.String()
+}
+
+func (gs *Storage) object(blobRef blob.Ref) *storage.ObjectHandle {
+	return gs.client.Bucket(gs.bucket).Object(gs.key(blobRef))
+}
+
+func (gs *Storage) Fetch(blobRef blob.Ref) (io.ReadCloser, int64, error) {
+	r, err := gs.object(blobRef).NewReader(gc.Background())
+	if err == storage.ErrObjectNotExist {
+		return nil, 0, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, r.Size(), nil
+}
+
+func (gs *Storage) StatBlobs(dest chan<- blob.SizedRef, blobs []blob.Ref) error {
+	ctx := gc.Background()
+	for _, br := range blobs {
+		attrs, err := gs.object(br).Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dest <- blob.SizedRef{Ref: br, Size: uint32(attrs.Size)}
+	}
+	return nil
+}
+
+// ReceiveBlob uploads the blob's contents to GCS as a chunked, resumable
+// upload. Retries with exponential backoff are handled internally by the
+// storage.Writer, so unlike the old hand-rolled client there is no
+// application-level retry loop here.
+func (gs *Storage) ReceiveBlob(blobRef blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	ctx := gc.Background()
+	w := gs.object(blobRef).NewWriter(ctx)
+	written, err := io.Copy(w, source)
+	if err != nil {
+		w.CloseWithError(err)
+		return blob.SizedRef{}, err
+	}
+	if err := w.Close(); err != nil {
+		return blob.SizedRef{}, err
+	}
+	return blob.SizedRef{Ref: blobRef, Size: uint32(written)}, nil
+}
+
+func (gs *Storage) RemoveBlobs(blobs []blob.Ref) error {
+	ctx := gc.Background()
+	for _, br := range blobs {
+		if err := gs.object(br).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gs *Storage) EnumerateBlobs(ctx *context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	defer close(dest)
+	it := gs.client.Bucket(gs.bucket).Objects(gc.Background(), &storage.Query{
+		Prefix:      gs.dirPrefix,
+		StartOffset: gs.dirPrefix + after,
+	})
+	n := 0
+	for n < limit {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		brStr := strings.TrimPrefix(attrs.Name, gs.dirPrefix)
+		if after != "" && brStr == after {
+			// StartOffset matches names lexicographically >= after,
+			// but the EnumerateBlobs contract is to resume strictly
+			// after it, so skip the inclusive boundary match.
+			continue
+		}
+		br, ok := blob.Parse(brStr)
+		if !ok {
+			continue
+		}
+		select {
+		case dest <- blob.SizedRef{Ref: br, Size: uint32(attrs.Size)}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n++
+	}
+	return nil
+}
+
+// SetBlobChangeReceiver registers recv to be notified of blobs written or
+// removed directly in the bucket by some other process, such as a parallel
+// uploader or another Camlistore instance sharing the bucket. Notifications
+// are not filtered by origin, so recv is also called for blobs written or
+// removed through this Storage itself. It has no effect unless
+// pubsub_subscription was set in the config, since that's what drives the
+// notification stream.
+func (gs *Storage) SetBlobChangeReceiver(recv blobserver.BlobChangeReceiver) {
+	gs.changesMu.Lock()
+	gs.changes = recv
+	gs.changesMu.Unlock()
+}
+
+// notifyLoop pulls GCS object-change notifications off sub until ctx is
+// canceled, forwarding OBJECT_FINALIZE and OBJECT_DELETE events to
+// gs.changes so an indexer can reconcile without a full re-enumerate.
+func (gs *Storage) notifyLoop(ctx gc.Context) {
+	defer close(gs.subDone)
+	err := gs.sub.Receive(ctx, func(_ gc.Context, msg *pubsub.Message) {
+		gs.handleNotification(msg)
+		msg.Ack()
+	})
+	if err != nil && err != gc.Canceled {
+		log.Printf("cloudstorage: pubsub notification consumer for %s stopped: %v", gs.bucket, err)
+	}
+}
+
+func (gs *Storage) handleNotification(msg *pubsub.Message) {
+	gs.changesMu.Lock()
+	recv := gs.changes
+	gs.changesMu.Unlock()
+	if recv == nil {
+		return
+	}
+	br, ok := blob.Parse(strings.TrimPrefix(msg.Attributes["objectId"], gs.dirPrefix))
+	if !ok {
+		return
+	}
+	switch msg.Attributes["eventType"] {
+	case "OBJECT_FINALIZE":
+		recv.OnBlobReceived(br)
+	case "OBJECT_DELETE":
+		recv.OnBlobRemoved(br)
+	}
+}
+
+// CreateNotification ensures the bucket has a Pub/Sub notification
+// configuration publishing OBJECT_FINALIZE and OBJECT_DELETE events to
+// topic, equivalent to running:
+//
+//	gsutil notification create -t topic -e OBJECT_FINALIZE -e OBJECT_DELETE gs://bucket
+//
+// It is a no-op if a notification configuration for topic already exists.
+func (gs *Storage) CreateNotification(topic string) error {
+	ctx := gc.Background()
+	bkt := gs.client.Bucket(gs.bucket)
+	existing, err := bkt.Notifications(ctx)
+	if err != nil {
+		return fmt.Errorf("cloudstorage: listing bucket notifications: %v", err)
+	}
+	for _, n := range existing {
+		if n.TopicID == topic {
+			return nil
+		}
+	}
+	_, err = bkt.AddNotification(ctx, &storage.Notification{
+		TopicID:    topic,
+		EventTypes: []string{storage.ObjectFinalizeEvent, storage.ObjectDeleteEvent},
+	})
+	if err != nil {
+		return fmt.Errorf("cloudstorage: creating bucket notification for topic %q: %v", topic, err)
+	}
+	return nil
+}
+
+// Close stops the Pub/Sub notification consumer, if pubsub_subscription
+// was configured, and waits for it to shut down. It is a no-op otherwise.
+func (gs *Storage) Close() error {
+	if gs.subCancel == nil {
+		return nil
+	}
+	gs.subCancel()
+	<-gs.subDone
+	return nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("googlecloudstorage", blobserver.StorageConstructor(newFromConfig))
+}
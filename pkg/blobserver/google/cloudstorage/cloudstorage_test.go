@@ -18,6 +18,7 @@ package cloudstorage
 
 import (
 	"flag"
+	"io"
 	"log"
 	"path"
 	"strings"
@@ -27,17 +28,19 @@ import (
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/blobserver/storagetest"
 	"camlistore.org/pkg/context"
-	"camlistore.org/pkg/googlestorage"
 	"camlistore.org/pkg/jsonconfig"
 	"camlistore.org/third_party/code.google.com/p/goauth2/oauth"
+
+	gc "golang.org/x/net/context"
 )
 
 var (
-	bucket       = flag.String("bucket", "", "Bucket name to use for testing. If empty, testing is skipped. If non-empty, it must begin with 'camlistore-' and end in '-test' and have zero items in it.")
-	clientID     = flag.String("client_id", "", "OAuth2 client_id for testing")
-	clientSecret = flag.String("client_secret", "", "OAuth2 client secret for testing")
-	tokenCache   = flag.String("token_cache", ".tokencache", "Token cache file.")
-	authCode     = flag.String("auth_code", "", "Use when instructed to do so, when the --token_cache is empty.")
+	bucket            = flag.String("bucket", "", "Bucket name to use for testing. If empty, testing is skipped. If non-empty, it must begin with 'camlistore-' and end in '-test' and have zero items in it.")
+	clientID          = flag.String("client_id", "", "OAuth2 client_id for testing")
+	clientSecret      = flag.String("client_secret", "", "OAuth2 client secret for testing")
+	tokenCache        = flag.String("token_cache", ".tokencache", "Token cache file.")
+	authCode          = flag.String("auth_code", "", "Use when instructed to do so, when the --token_cache is empty.")
+	serviceAccountKey = flag.String("service_account_json", "", "Path to a service account JSON key file, used instead of --client_id/--client_secret/--auth_code for non-interactive (e.g. CI) runs.")
 )
 
 func TestStorage(t *testing.T) {
@@ -55,35 +58,45 @@ func testStorage(t *testing.T, bucketDir string) {
 	if !strings.HasPrefix(*bucket, "camlistore-") || !strings.HasSuffix(*bucket, "-test") {
 		t.Fatalf("bogus bucket name %q; must begin with 'camlistore-' and end in '-test'", *bucket)
 	}
-	if *clientID == "" || *clientSecret == "" {
-		t.Fatal("--client_id and --client_secret required. Obtain from https://console.developers.google.com/ > Project > APIs & Auth > Credentials. Should be a 'native' or 'Installed application'")
-	}
 
-	tokenCache := oauth.CacheFile(*tokenCache)
-	token, err := tokenCache.Token()
-	if err != nil {
-		config := &oauth.Config{
-			// The client-id and secret should be for an "Installed Application" when using
-			// the CLI. Later we'll use a web application with a callback.
-			ClientId:     *clientID,
-			ClientSecret: *clientSecret,
-			Scope:        "https://www.googleapis.com/auth/devstorage.full_control",
-			AuthURL:      "https://accounts.google.com/o/oauth2/auth",
-			TokenURL:     "https://accounts.google.com/o/oauth2/token",
-			RedirectURL:  "urn:ietf:wg:oauth:2.0:oob",
+	auth := map[string]interface{}{}
+	if *serviceAccountKey != "" {
+		auth["json_key"] = *serviceAccountKey
+	} else {
+		if *clientID == "" || *clientSecret == "" {
+			t.Fatal("--client_id and --client_secret (or --service_account_json) required. Obtain from https://console.developers.google.com/ > Project > APIs & Auth > Credentials. Should be a 'native' or 'Installed application'")
 		}
-		if *authCode != "" {
-			tr := &oauth.Transport{
-				Config: config,
+
+		tokenCache := oauth.CacheFile(*tokenCache)
+		token, err := tokenCache.Token()
+		if err != nil {
+			config := &oauth.Config{
+				// The client-id and secret should be for an "Installed Application" when using
+				// the CLI. Later we'll use a web application with a callback.
+				ClientId:     *clientID,
+				ClientSecret: *clientSecret,
+				Scope:        "https://www.googleapis.com/auth/devstorage.full_control",
+				AuthURL:      "https://accounts.google.com/o/oauth2/auth",
+				TokenURL:     "https://accounts.google.com/o/oauth2/token",
+				RedirectURL:  "urn:ietf:wg:oauth:2.0:oob",
 			}
-			token, err = tr.Exchange(*authCode)
-			if err != nil {
-				t.Fatalf("Error getting a token using auth code: %v", err)
+			if *authCode != "" {
+				tr := &oauth.Transport{
+					Config: config,
+				}
+				token, err = tr.Exchange(*authCode)
+				if err != nil {
+					t.Fatalf("Error getting a token using auth code: %v", err)
+				}
+				tokenCache.PutToken(token)
+			} else {
+				t.Skipf("Re-run using --auth_code= with the value obtained from %s", config.AuthCodeURL(""))
 			}
-			tokenCache.PutToken(token)
-		} else {
-			t.Skipf("Re-run using --auth_code= with the value obtained from %s", config.AuthCodeURL(""))
 		}
+
+		auth["client_id"] = *clientID
+		auth["client_secret"] = *clientSecret
+		auth["refresh_token"] = token.RefreshToken
 	}
 
 	bucketWithDir := path.Join(*bucket, bucketDir)
@@ -92,11 +105,7 @@ func testStorage(t *testing.T, bucketDir string) {
 		New: func(t *testing.T) (sto blobserver.Storage, cleanup func()) {
 			sto, err := newFromConfig(nil, jsonconfig.Obj{
 				"bucket": bucketWithDir,
-				"auth": map[string]interface{}{
-					"client_id":     *clientID,
-					"client_secret": *clientSecret,
-					"refresh_token": token.RefreshToken,
-				},
+				"auth":   auth,
 			})
 			if err != nil {
 				t.Fatal(err)
@@ -108,12 +117,11 @@ func testStorage(t *testing.T, bucketDir string) {
 				// Adding "a", and "c" objects in the bucket to make sure objects out of the
 				// "directory" are not touched and have no influence.
 				for _, key := range []string{"a", "c"} {
-					for tries, shouldRetry := 0, true; tries < 2 && shouldRetry; tries++ {
-						shouldRetry, err = sto.(*Storage).client.PutObject(
-							&googlestorage.Object{Bucket: sto.(*Storage).bucket, Key: key},
-							strings.NewReader(key))
+					w := sto.(*Storage).client.Bucket(sto.(*Storage).bucket).Object(key).NewWriter(gc.Background())
+					if _, err := io.Copy(w, strings.NewReader(key)); err != nil {
+						t.Fatalf("could not insert object %s in bucket %v: %v", key, sto.(*Storage).bucket, err)
 					}
-					if err != nil {
+					if err := w.Close(); err != nil {
 						t.Fatalf("could not insert object %s in bucket %v: %v", key, sto.(*Storage).bucket, err)
 					}
 				}
@@ -136,11 +144,11 @@ func testStorage(t *testing.T, bucketDir string) {
 					if bucketWithDir != *bucket {
 						// checking that "a" and "c" at the root were left untouched.
 						for _, key := range []string{"a", "c"} {
-							if _, _, err := sto.(*Storage).client.GetObject(&googlestorage.Object{Bucket: sto.(*Storage).bucket,
-								Key: key}); err != nil {
+							obj := sto.(*Storage).client.Bucket(sto.(*Storage).bucket).Object(key)
+							if _, err := obj.Attrs(gc.Background()); err != nil {
 								t.Fatalf("could not find object %s after tests: %v", key, err)
 							}
-							if err := sto.(*Storage).client.DeleteObject(&googlestorage.Object{Bucket: sto.(*Storage).bucket, Key: key}); err != nil {
+							if err := obj.Delete(gc.Background()); err != nil {
 								t.Fatalf("could not remove object %s after tests: %v", key, err)
 							}
 
@@ -0,0 +1,407 @@
+/*
+Copyright 2014 The Camlistore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudstorage
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blob"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/context"
+	"camlistore.org/pkg/jsonconfig"
+
+	"cloud.google.com/go/storage"
+	gc "golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// defaultPartSize is the default maximum size, in bytes, of each GCS
+	// object a sharded blob is split into.
+	defaultPartSize = 512 << 20 // 512MiB
+
+	// defaultMaxParts is the default maximum number of parts a logical
+	// blob may be split into. Its product with defaultPartSize is kept
+	// under maxUint32, the largest size blob.SizedRef.Size can report,
+	// since that's the tighter of the two limits (the GCS compose API's
+	// 32-source-object limit is the other).
+	defaultMaxParts = 7
+
+	// maxComposeSources is the GCS compose API's limit on the number of
+	// source objects in a single compose call. Since ReceiveBlob always
+	// composes every part in one call, maxParts can never exceed this.
+	maxComposeSources = 32
+
+	// maxUint32 is the largest size representable in a blob.SizedRef,
+	// whose Size field is a uint32.
+	maxUint32 = math.MaxUint32
+
+	// partSuffixFormat produces deterministic, order-preserving part
+	// names: "<ref>.part000", "<ref>.part001", etc.
+	partSuffixFormat = ".part%03d"
+)
+
+// ShardingStorage wraps a Storage, transparently splitting any blob larger
+// than partSize across multiple GCS objects ("parts"), composed server-side
+// into the canonical object name once all parts are written. This sidesteps
+// having to buffer an entire large blob before we know it's safe to finalize,
+// at the cost of a bounded number of extra objects per oversized blob. A
+// process that crashes mid-upload can leave parts behind; call
+// ReapStaleParts periodically to reclaim them.
+type ShardingStorage struct {
+	*Storage
+	partSize int64
+	maxParts int
+}
+
+func newShardingFromConfig(loader blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	partSize := config.OptionalInt64("max_part_size", defaultPartSize)
+	maxParts := config.OptionalInt("max_parts", defaultMaxParts)
+
+	sto, err := newFromConfig(loader, config)
+	if err != nil {
+		return nil, err
+	}
+	if partSize <= 0 {
+		return nil, fmt.Errorf("cloudstorage: max_part_size must be positive, got %d", partSize)
+	}
+	if maxParts <= 1 {
+		return nil, fmt.Errorf("cloudstorage: max_parts must be greater than 1, got %d", maxParts)
+	}
+	if maxParts > maxComposeSources {
+		return nil, fmt.Errorf("cloudstorage: max_parts must be at most %d (the GCS compose API's source-object limit), got %d", maxComposeSources, maxParts)
+	}
+	if partSize > maxUint32/int64(maxParts) {
+		return nil, fmt.Errorf("cloudstorage: max_part_size (%d) * max_parts (%d) would exceed %d, the largest size a blob.SizedRef can report; reduce one of them",
+			partSize, maxParts, uint32(maxUint32))
+	}
+
+	return &ShardingStorage{
+		Storage:  sto.(*Storage),
+		partSize: partSize,
+		maxParts: maxParts,
+	}, nil
+}
+
+func (ss *ShardingStorage) partKey(blobRef blob.Ref, part int) string {
+	return ss.key(blobRef) + fmt.Sprintf(partSuffixFormat, part)
+}
+
+func (ss *ShardingStorage) partObject(blobRef blob.Ref, part int) *storage.ObjectHandle {
+	return ss.client.Bucket(ss.bucket).Object(ss.partKey(blobRef, part))
+}
+
+// maxLogicalSize is the largest blob ShardingStorage can accept, given its
+// configured partSize and maxParts.
+func (ss *ShardingStorage) maxLogicalSize() int64 {
+	return ss.partSize * int64(ss.maxParts)
+}
+
+// ReceiveBlob writes source across one or more "<ref>.partNNN" objects of at
+// most partSize bytes each, streaming directly into each part's Writer and
+// rolling over to the next part only once partSize bytes have actually been
+// written, so memory use stays bounded regardless of the blob's size. Once
+// source is exhausted, the parts are composed server-side into the
+// canonical object name and the now-redundant parts are removed.
+func (ss *ShardingStorage) ReceiveBlob(blobRef blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	ctx := gc.Background()
+
+	var parts []int
+	cleanup := func() {
+		for _, p := range parts {
+			ss.partObject(blobRef, p).Delete(ctx)
+		}
+	}
+
+	// lead carries the one byte of lookahead needed to tell, without
+	// buffering, whether a part that just filled up to partSize was
+	// also the end of source.
+	var total int64
+	var lead [1]byte
+	leadN, leadErr := io.ReadFull(source, lead[:])
+	for part := 0; leadN > 0; part++ {
+		if part >= ss.maxParts {
+			cleanup()
+			return blob.SizedRef{}, fmt.Errorf("cloudstorage: blob %v exceeds the %d-byte sharding limit (%d parts of %d bytes)",
+				blobRef, ss.maxLogicalSize(), ss.maxParts, ss.partSize)
+		}
+		w := ss.partObject(blobRef, part).NewWriter(ctx)
+		if _, err := w.Write(lead[:leadN]); err != nil {
+			w.CloseWithError(err)
+			cleanup()
+			return blob.SizedRef{}, err
+		}
+		n, err := io.CopyN(w, source, ss.partSize-1)
+		if err != nil && err != io.EOF {
+			w.CloseWithError(err)
+			cleanup()
+			return blob.SizedRef{}, err
+		}
+		if cerr := w.Close(); cerr != nil {
+			cleanup()
+			return blob.SizedRef{}, cerr
+		}
+		parts = append(parts, part)
+		total += int64(leadN) + n
+
+		leadN, leadErr = io.ReadFull(source, lead[:])
+	}
+	if leadErr != nil && leadErr != io.EOF && leadErr != io.ErrUnexpectedEOF {
+		cleanup()
+		return blob.SizedRef{}, leadErr
+	}
+
+	if len(parts) == 0 {
+		// Empty blob: nothing was ever written to a part, so just
+		// create an empty canonical object directly.
+		w := ss.object(blobRef).NewWriter(ctx)
+		if err := w.Close(); err != nil {
+			return blob.SizedRef{}, err
+		}
+		return blob.SizedRef{Ref: blobRef, Size: 0}, nil
+	}
+
+	srcs := make([]*storage.ObjectHandle, len(parts))
+	for i, p := range parts {
+		srcs[i] = ss.partObject(blobRef, p)
+	}
+	if _, err := ss.object(blobRef).ComposerFrom(srcs...).Run(ctx); err != nil {
+		cleanup()
+		return blob.SizedRef{}, fmt.Errorf("cloudstorage: composing %d parts of %v: %v", len(parts), blobRef, err)
+	}
+	cleanup()
+
+	if total > maxUint32 {
+		return blob.SizedRef{}, fmt.Errorf("cloudstorage: blob %v has size %d, which overflows the uint32 blob.SizedRef.Size (max %d); lower max_part_size or max_parts",
+			blobRef, total, uint32(maxUint32))
+	}
+	return blob.SizedRef{Ref: blobRef, Size: uint32(total)}, nil
+}
+
+// Fetch returns the canonical object's contents. If the canonical object is
+// missing but leftover parts remain from a ReceiveBlob that was interrupted
+// before it could compose (or clean up) them, Fetch stitches those parts
+// back together instead of failing, so a retried enumerate doesn't see a
+// phantom missing blob.
+func (ss *ShardingStorage) Fetch(blobRef blob.Ref) (io.ReadCloser, int64, error) {
+	rc, size, err := ss.Storage.Fetch(blobRef)
+	if err == nil {
+		return rc, size, nil
+	}
+
+	parts, partSize, ferr := ss.findParts(blobRef)
+	if ferr != nil || len(parts) == 0 {
+		return nil, 0, err
+	}
+	return ss.stitchParts(blobRef, parts, partSize)
+}
+
+// findParts lists any leftover "<ref>.partNNN" objects for blobRef, in
+// order, along with their total size.
+func (ss *ShardingStorage) findParts(blobRef blob.Ref) ([]int, int64, error) {
+	ctx := gc.Background()
+	it := ss.client.Bucket(ss.bucket).Objects(ctx, &storage.Query{Prefix: ss.key(blobRef) + ".part"})
+	var parts []int
+	var total int64
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var part int
+		if _, err := fmt.Sscanf(attrs.Name, ss.key(blobRef)+partSuffixFormat, &part); err != nil {
+			continue
+		}
+		parts = append(parts, part)
+		total += attrs.Size
+	}
+	return parts, total, nil
+}
+
+// stitchParts returns a ReadCloser that reads each part object in order via
+// NewRangeReader, concatenating them into the logical blob's contents.
+func (ss *ShardingStorage) stitchParts(blobRef blob.Ref, parts []int, total int64) (io.ReadCloser, int64, error) {
+	return &partsReader{ss: ss, blobRef: blobRef, parts: parts}, total, nil
+}
+
+type partsReader struct {
+	ss      *ShardingStorage
+	blobRef blob.Ref
+	parts   []int
+	cur     io.ReadCloser
+}
+
+func (p *partsReader) Read(buf []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			part := p.parts[0]
+			p.parts = p.parts[1:]
+			rc, err := p.ss.partObject(p.blobRef, part).NewRangeReader(gc.Background(), 0, -1)
+			if err != nil {
+				return 0, err
+			}
+			p.cur = rc
+		}
+		n, err := p.cur.Read(buf)
+		if err == io.EOF {
+			p.cur.Close()
+			p.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.cur != nil {
+		return p.cur.Close()
+	}
+	return nil
+}
+
+// StatBlobs delegates to the embedded Storage; a blob left only as unfinished
+// parts (no composed canonical object) is correctly reported as absent here,
+// matching EnumerateBlobs.
+func (ss *ShardingStorage) StatBlobs(dest chan<- blob.SizedRef, blobs []blob.Ref) error {
+	return ss.Storage.StatBlobs(dest, blobs)
+}
+
+// EnumerateBlobs delegates to the embedded Storage, which lists canonical
+// objects under dirPrefix; leftover, never-composed ".partNNN" objects don't
+// parse as blob.Refs and are silently skipped rather than surfaced as blobs.
+// Call ReapStaleParts periodically to reclaim those instead of leaking them
+// forever.
+func (ss *ShardingStorage) EnumerateBlobs(ctx *context.Context, dest chan<- blob.SizedRef, after string, limit int) error {
+	return ss.Storage.EnumerateBlobs(ctx, dest, after, limit)
+}
+
+// partGroup tracks the part numbers seen for one blobRef during a bucket-wide
+// part scan, along with the most recent time any of them was written.
+type partGroup struct {
+	parts        []int
+	lastModified time.Time
+}
+
+// findAllParts scans the whole bucket for "<ref>.partNNN" objects, grouping
+// their part numbers by the blobRef they belong to. It's the bucket-wide
+// counterpart to findParts, which only looks at one blobRef at a time.
+func (ss *ShardingStorage) findAllParts(ctx gc.Context) (map[blob.Ref]*partGroup, error) {
+	it := ss.client.Bucket(ss.bucket).Objects(ctx, &storage.Query{Prefix: ss.dirPrefix})
+	groups := map[blob.Ref]*partGroup{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rest := strings.TrimPrefix(attrs.Name, ss.dirPrefix)
+		i := strings.LastIndex(rest, ".part")
+		if i < 0 {
+			continue
+		}
+		var part int
+		if _, err := fmt.Sscanf(rest[i:], partSuffixFormat, &part); err != nil {
+			continue
+		}
+		br, ok := blob.Parse(rest[:i])
+		if !ok {
+			continue
+		}
+		g := groups[br]
+		if g == nil {
+			g = &partGroup{}
+			groups[br] = g
+		}
+		g.parts = append(g.parts, part)
+		if attrs.Updated.After(g.lastModified) {
+			g.lastModified = attrs.Updated
+		}
+	}
+	return groups, nil
+}
+
+// ReapStaleParts scans the bucket for "<ref>.partNNN" objects left behind by
+// a ReceiveBlob that never finished, and deletes the ones it's safe to
+// reclaim: parts whose canonical object already exists (the compose
+// succeeded but the following cleanup didn't get to run), and parts with no
+// canonical object that haven't been written to in minAge, which means the
+// upload that created them was abandoned rather than merely in progress. It
+// returns the blobRefs it reaped parts for, so a caller can log them.
+func (ss *ShardingStorage) ReapStaleParts(minAge time.Duration) ([]blob.Ref, error) {
+	ctx := gc.Background()
+	groups, err := ss.findAllParts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var reaped []blob.Ref
+	for br, g := range groups {
+		if _, err := ss.object(br).Attrs(ctx); err != nil && now.Sub(g.lastModified) < minAge {
+			// No canonical object yet, and a part was written
+			// recently enough that ReceiveBlob may still be
+			// running. Leave it alone.
+			continue
+		}
+		for _, part := range g.parts {
+			if err := ss.partObject(br, part).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+				return reaped, err
+			}
+		}
+		reaped = append(reaped, br)
+	}
+	return reaped, nil
+}
+
+// RemoveBlobs removes each blob's canonical object along with any leftover
+// part objects left behind by an interrupted ReceiveBlob.
+func (ss *ShardingStorage) RemoveBlobs(blobs []blob.Ref) error {
+	if err := ss.Storage.RemoveBlobs(blobs); err != nil {
+		return err
+	}
+	gctx := gc.Background()
+	for _, br := range blobs {
+		parts, _, err := ss.findParts(br)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err := ss.partObject(br, part).Delete(gctx); err != nil && err != storage.ErrObjectNotExist {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("googlecloudstorage-sharded", blobserver.StorageConstructor(newShardingFromConfig))
+}
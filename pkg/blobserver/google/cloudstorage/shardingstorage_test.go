@@ -0,0 +1,412 @@
+/*
+Copyright 2014 The Camlistore Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudstorage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blob"
+
+	"cloud.google.com/go/storage"
+	gc "golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+// fakeGCSTransport is a minimal in-memory stand-in for the GCS JSON API,
+// just enough of it for ShardingStorage's resumable-upload, get, list,
+// delete and compose calls to work against, without talking to a real
+// bucket or requiring the --bucket integration flag.
+type fakeGCSTransport struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	updated map[string]time.Time
+}
+
+// setUpdated overrides the "updated" timestamp a subsequent metadata fetch
+// or list will report for name, letting tests simulate parts written long
+// ago without actually waiting.
+func (f *fakeGCSTransport) setUpdated(name string, t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updated[name] = t
+}
+
+func newFakeGCSClient(t *testing.T) (*storage.Client, *fakeGCSTransport) {
+	transport := &fakeGCSTransport{objects: map[string][]byte{}, updated: map[string]time.Time{}}
+	client, err := storage.NewClient(gc.Background(), option.WithHTTPClient(&http.Client{
+		Transport: transport,
+	}))
+	if err != nil {
+		t.Fatalf("newFakeGCSClient: %v", err)
+	}
+	return client, transport
+}
+
+func (f *fakeGCSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := req.URL.Query()
+	switch {
+	case req.Method == "POST" && q.Get("uploadType") == "resumable":
+		loc := "https://fake-gcs-upload/" + url.QueryEscape(q.Get("name"))
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Location": []string{loc}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+
+	case req.Method == "PUT" && req.URL.Host == "fake-gcs-upload":
+		name, _ := url.QueryUnescape(strings.TrimPrefix(req.URL.Path, "/"))
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.objects[name] = data
+		f.updated[name] = time.Now()
+		return f.jsonResponse(200, name, data)
+
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/compose"):
+		return f.handleCompose(req)
+
+	case req.Method == "GET" && q.Get("alt") == "media":
+		name := objectNameFromPath(req.URL.Path)
+		data, ok := f.objects[name]
+		if !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return f.rangeResponse(req, data)
+
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/o"):
+		return f.handleList(q)
+
+	case req.Method == "GET":
+		name := objectNameFromPath(req.URL.Path)
+		data, ok := f.objects[name]
+		if !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		return f.jsonResponse(200, name, data)
+
+	case req.Method == "DELETE":
+		name := objectNameFromPath(req.URL.Path)
+		if _, ok := f.objects[name]; !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		delete(f.objects, name)
+		return &http.Response{StatusCode: 204, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+
+	return &http.Response{StatusCode: 400, Body: ioutil.NopCloser(strings.NewReader("unhandled request"))}, nil
+}
+
+func (f *fakeGCSTransport) handleCompose(req *http.Request) (*http.Response, error) {
+	var body struct {
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	var composed []byte
+	for _, src := range body.SourceObjects {
+		data, ok := f.objects[src.Name]
+		if !ok {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+		composed = append(composed, data...)
+	}
+	dest := objectNameFromPath(strings.TrimSuffix(req.URL.Path, "/compose"))
+	f.objects[dest] = composed
+	f.updated[dest] = time.Now()
+	return f.jsonResponse(200, dest, composed)
+}
+
+func (f *fakeGCSTransport) handleList(q url.Values) (*http.Response, error) {
+	prefix := q.Get("prefix")
+	startOffset := q.Get("startOffset")
+	var items []map[string]interface{}
+	for name, data := range f.objects {
+		if prefix != "" && !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if startOffset != "" && name < startOffset {
+			continue
+		}
+		items = append(items, map[string]interface{}{
+			"name":    name,
+			"size":    strconv.Itoa(len(data)),
+			"updated": f.updatedTime(name).Format(time.RFC3339Nano),
+		})
+	}
+	body, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func (f *fakeGCSTransport) rangeResponse(req *http.Request, data []byte) (*http.Response, error) {
+	rangeHdr := req.Header.Get("Range")
+	if rangeHdr == "" {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(rangeHdr, "bytes=%d-%d", &start, &end); err == nil {
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		return &http.Response{StatusCode: 206, Body: ioutil.NopCloser(bytes.NewReader(data[start : end+1]))}, nil
+	}
+	if _, err := fmt.Sscanf(rangeHdr, "bytes=%d-", &start); err == nil {
+		return &http.Response{StatusCode: 206, Body: ioutil.NopCloser(bytes.NewReader(data[start:]))}, nil
+	}
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+// updatedTime returns the timestamp a previous write recorded for name, or
+// now if none was recorded (e.g. name was never written through the fake's
+// normal write paths).
+func (f *fakeGCSTransport) updatedTime(name string) time.Time {
+	if t, ok := f.updated[name]; ok {
+		return t
+	}
+	return time.Now()
+}
+
+func (f *fakeGCSTransport) jsonResponse(status int, name string, data []byte) (*http.Response, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"name":    name,
+		"size":    strconv.Itoa(len(data)),
+		"updated": f.updatedTime(name).Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// objectNameFromPath extracts the object name from a "/b/{bucket}/o/{name}"
+// style path, the only shape the fake needs to understand.
+func objectNameFromPath(path string) string {
+	i := strings.Index(path, "/o/")
+	if i < 0 {
+		return ""
+	}
+	name, _ := url.QueryUnescape(path[i+len("/o/"):])
+	return name
+}
+
+func newTestShardingStorage(t *testing.T, partSize int64, maxParts int) (*ShardingStorage, *fakeGCSTransport) {
+	client, transport := newFakeGCSClient(t)
+	return &ShardingStorage{
+		Storage: &Storage{
+			client: client,
+			bucket: "camlistore-test",
+		},
+		partSize: partSize,
+		maxParts: maxParts,
+	}, transport
+}
+
+func blobOfSize(n int) (blob.Ref, []byte) {
+	data := bytes.Repeat([]byte{'x'}, n)
+	return blob.SHA1FromBytes(data), data
+}
+
+func (ss *ShardingStorage) partCount(t *testing.T, blobRef blob.Ref) int {
+	parts, _, err := ss.findParts(blobRef)
+	if err != nil {
+		t.Fatalf("findParts: %v", err)
+	}
+	return len(parts)
+}
+
+func testReceiveAndFetch(t *testing.T, ss *ShardingStorage, size int) {
+	blobRef, data := blobOfSize(size)
+	sb, err := ss.ReceiveBlob(blobRef, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReceiveBlob(size=%d): %v", size, err)
+	}
+	if sb.Size != uint32(size) {
+		t.Fatalf("ReceiveBlob(size=%d): got size %d", size, sb.Size)
+	}
+	if n := ss.partCount(t, blobRef); n != 0 {
+		t.Fatalf("ReceiveBlob(size=%d): left %d leftover part(s); want 0 after a successful compose", size, n)
+	}
+
+	rc, fetchedSize, err := ss.Fetch(blobRef)
+	if err != nil {
+		t.Fatalf("Fetch(size=%d): %v", size, err)
+	}
+	defer rc.Close()
+	if fetchedSize != int64(size) {
+		t.Fatalf("Fetch(size=%d): got size %d", size, fetchedSize)
+	}
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Fetch(size=%d): reading: %v", size, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Fetch(size=%d): content mismatch", size)
+	}
+}
+
+func TestShardingStorageReceiveBlob_SinglePart(t *testing.T) {
+	ss, _ := newTestShardingStorage(t, 100, 4)
+	testReceiveAndFetch(t, ss, 10)
+}
+
+func TestShardingStorageReceiveBlob_ExactlyPartSize(t *testing.T) {
+	ss, _ := newTestShardingStorage(t, 100, 4)
+	testReceiveAndFetch(t, ss, 100)
+}
+
+func TestShardingStorageReceiveBlob_MultipleOfPartSize(t *testing.T) {
+	ss, _ := newTestShardingStorage(t, 100, 4)
+	testReceiveAndFetch(t, ss, 300)
+}
+
+func TestShardingStorageReceiveBlob_Empty(t *testing.T) {
+	ss, _ := newTestShardingStorage(t, 100, 4)
+	testReceiveAndFetch(t, ss, 0)
+}
+
+func TestShardingStorageReceiveBlob_ExceedsMaxParts(t *testing.T) {
+	ss, _ := newTestShardingStorage(t, 100, 2)
+	blobRef, data := blobOfSize(201)
+	if _, err := ss.ReceiveBlob(blobRef, bytes.NewReader(data)); err == nil {
+		t.Fatal("ReceiveBlob: got no error for a blob exceeding the sharding limit")
+	}
+	if n := ss.partCount(t, blobRef); n != 0 {
+		t.Fatalf("ReceiveBlob: left %d leftover part(s) after a failed upload; want 0", n)
+	}
+}
+
+// TestShardingStorageFetch_StitchesLeftoverParts simulates a crash between
+// writing a blob's parts and composing them: it writes the parts directly,
+// bypassing ReceiveBlob, and checks that Fetch still reassembles the
+// original content from them.
+func TestShardingStorageFetch_StitchesLeftoverParts(t *testing.T) {
+	ss, _ := newTestShardingStorage(t, 10, 4)
+	blobRef, data := blobOfSize(22)
+	ctx := gc.Background()
+	chunks := [][]byte{data[0:10], data[10:20], data[20:22]}
+	for i, chunk := range chunks {
+		w := ss.partObject(blobRef, i).NewWriter(ctx)
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatalf("writing part %d: %v", i, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("closing part %d: %v", i, err)
+		}
+	}
+
+	rc, size, err := ss.Fetch(blobRef)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	defer rc.Close()
+	if size != int64(len(data)) {
+		t.Fatalf("Fetch: got size %d, want %d", size, len(data))
+	}
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Fetch: reading: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Fetch: stitched content doesn't match the original parts")
+	}
+}
+
+func TestShardingStorageReapStaleParts(t *testing.T) {
+	ss, transport := newTestShardingStorage(t, 10, 4)
+	ctx := gc.Background()
+	writePart := func(blobRef blob.Ref, part int, data []byte, age time.Duration) {
+		w := ss.partObject(blobRef, part).NewWriter(ctx)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("writing part: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("closing part: %v", err)
+		}
+		transport.setUpdated(ss.partKey(blobRef, part), time.Now().Add(-age))
+	}
+
+	// composedRef: the compose already finished (canonical object
+	// exists), but cleanup never ran. Its leftover parts are always
+	// safe to reap, regardless of age.
+	composedRef, composedData := blobOfSize(20)
+	writePart(composedRef, 0, composedData[0:10], time.Minute)
+	writePart(composedRef, 1, composedData[10:20], time.Minute)
+	if _, err := ss.object(composedRef).ComposerFrom(ss.partObject(composedRef, 0), ss.partObject(composedRef, 1)).Run(ctx); err != nil {
+		t.Fatalf("composing fixture: %v", err)
+	}
+
+	// freshRef: parts written moments ago with no canonical object yet,
+	// as if ReceiveBlob is still running. Must not be reaped.
+	freshRef, freshData := blobOfSize(5)
+	writePart(freshRef, 0, freshData, time.Second)
+
+	// abandonedRef: parts written long ago with no canonical object,
+	// as if the process that was writing them died. Must be reaped.
+	abandonedRef, abandonedData := blobOfSize(6)
+	writePart(abandonedRef, 0, abandonedData, time.Hour)
+
+	reaped, err := ss.ReapStaleParts(time.Minute)
+	if err != nil {
+		t.Fatalf("ReapStaleParts: %v", err)
+	}
+	got := map[blob.Ref]bool{}
+	for _, br := range reaped {
+		got[br] = true
+	}
+	if !got[composedRef] {
+		t.Error("ReapStaleParts: did not reap parts left over from a finished compose")
+	}
+	if !got[abandonedRef] {
+		t.Error("ReapStaleParts: did not reap parts from an old, abandoned upload")
+	}
+	if got[freshRef] {
+		t.Error("ReapStaleParts: reaped parts from an upload that may still be in progress")
+	}
+	if n := ss.partCount(t, composedRef); n != 0 {
+		t.Errorf("ReapStaleParts: left %d part(s) behind for composedRef", n)
+	}
+	if n := ss.partCount(t, freshRef); n != 1 {
+		t.Errorf("ReapStaleParts: got %d part(s) for freshRef, want 1 untouched", n)
+	}
+}